@@ -0,0 +1,189 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	fh "github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+// metricsConfig controls the optional /metrics endpoint. It is disabled
+// by default.
+type metricsConfig struct {
+	Enable bool `yaml:"enable"`
+
+	// Listen, if set, serves /metrics on its own listener instead of
+	// the main server.
+	Listen string `yaml:"listen"`
+
+	// TenantAllowlist caps per-tenant label cardinality: tenants not on
+	// the list (when the list is non-empty) are bucketed into
+	// metricsOtherTenant instead of getting their own label value.
+	TenantAllowlist []string `yaml:"tenant_allowlist"`
+}
+
+// metricsOtherTenant is the label value used for tenants outside the
+// configured allowlist, to keep cardinality bounded.
+const metricsOtherTenant = "__other__"
+
+// metrics holds the Prometheus collectors exposed on /metrics, broken
+// down by tenant and outcome where it matters.
+type metrics struct {
+	cfg     metricsConfig
+	allowed map[string]struct{}
+
+	handler fh.RequestHandler
+
+	requestsTotal     *prometheus.CounterVec
+	samplesTotal      *prometheus.CounterVec
+	timeseriesTotal   *prometheus.CounterVec
+	upstreamDuration  *prometheus.HistogramVec
+	upstreamBodyBytes *prometheus.HistogramVec
+
+	bufferPoolGets   prometheus.Counter
+	dispatchInFlight prometheus.Gauge
+
+	retriesTotal            *prometheus.CounterVec
+	breakerTransitionsTotal *prometheus.CounterVec
+}
+
+func newMetrics(cfg metricsConfig) *metrics {
+	m := &metrics{cfg: cfg}
+
+	if len(cfg.TenantAllowlist) > 0 {
+		m.allowed = make(map[string]struct{}, len(cfg.TenantAllowlist))
+		for _, t := range cfg.TenantAllowlist {
+			m.allowed[t] = struct{}{}
+		}
+	}
+
+	m.requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cortex_tenant_requests_total",
+		Help: "Total number of upstream requests, by tenant and response code.",
+	}, []string{"tenant", "code"})
+
+	m.samplesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cortex_tenant_samples_total",
+		Help: "Total number of samples processed, by tenant.",
+	}, []string{"tenant"})
+
+	m.timeseriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cortex_tenant_timeseries_total",
+		Help: "Total number of timeseries processed, by tenant.",
+	}, []string{"tenant"})
+
+	m.upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cortex_tenant_upstream_duration_seconds",
+		Help:    "Latency of upstream requests, by tenant.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"tenant"})
+
+	m.upstreamBodyBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cortex_tenant_upstream_body_bytes",
+		Help:    "Size of the Snappy-compressed body sent upstream, by tenant.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 8),
+	}, []string{"tenant"})
+
+	m.bufferPoolGets = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cortex_tenant_buffer_pool_gets_total",
+		Help: "Total number of buffers obtained from the shared pool.",
+	})
+
+	m.dispatchInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cortex_tenant_dispatch_in_flight",
+		Help: "Number of per-tenant upstream dispatches currently in flight.",
+	})
+
+	m.retriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cortex_tenant_retries_total",
+		Help: "Total number of upstream send retries, by tenant.",
+	}, []string{"tenant"})
+
+	m.breakerTransitionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cortex_tenant_breaker_transitions_total",
+		Help: "Total number of circuit breaker state transitions, by target and new state.",
+	}, []string{"target", "state"})
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		m.requestsTotal,
+		m.samplesTotal,
+		m.timeseriesTotal,
+		m.upstreamDuration,
+		m.upstreamBodyBytes,
+		m.bufferPoolGets,
+		m.dispatchInFlight,
+		m.retriesTotal,
+		m.breakerTransitionsTotal,
+	)
+
+	m.handler = fasthttpadaptor.NewFastHTTPHandler(promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	return m
+}
+
+// tenantLabel maps a tenant to the label value it should be recorded
+// under, bucketing anything outside the allowlist into __other__.
+func (m *metrics) tenantLabel(tenant string) string {
+	if m.allowed == nil {
+		return tenant
+	}
+
+	if _, ok := m.allowed[tenant]; ok {
+		return tenant
+	}
+
+	return metricsOtherTenant
+}
+
+func (m *metrics) observeIngest(tenant string, samples, timeseries int) {
+	if !m.cfg.Enable {
+		return
+	}
+
+	tenant = m.tenantLabel(tenant)
+	m.samplesTotal.WithLabelValues(tenant).Add(float64(samples))
+	m.timeseriesTotal.WithLabelValues(tenant).Add(float64(timeseries))
+}
+
+func (m *metrics) observeRequest(tenant, code string, dur time.Duration, bodyBytes int) {
+	if !m.cfg.Enable {
+		return
+	}
+
+	tenant = m.tenantLabel(tenant)
+	m.requestsTotal.WithLabelValues(tenant, code).Inc()
+	m.upstreamDuration.WithLabelValues(tenant).Observe(dur.Seconds())
+	m.upstreamBodyBytes.WithLabelValues(tenant).Observe(float64(bodyBytes))
+}
+
+func (m *metrics) bufferGet() {
+	if m.cfg.Enable {
+		m.bufferPoolGets.Inc()
+	}
+}
+
+func (m *metrics) dispatchStart() {
+	if m.cfg.Enable {
+		m.dispatchInFlight.Inc()
+	}
+}
+
+func (m *metrics) dispatchEnd() {
+	if m.cfg.Enable {
+		m.dispatchInFlight.Dec()
+	}
+}
+
+func (m *metrics) observeRetry(tenant string) {
+	if m.cfg.Enable {
+		m.retriesTotal.WithLabelValues(m.tenantLabel(tenant)).Inc()
+	}
+}
+
+func (m *metrics) observeBreakerTransition(target string, to breakerState) {
+	if m.cfg.Enable {
+		m.breakerTransitionsTotal.WithLabelValues(target, to.String()).Inc()
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"net"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -17,6 +18,10 @@ import (
 )
 
 type result struct {
+	tenant    string
+	targetURL string
+	wrReq     *prompb.WriteRequest
+
 	code int
 	body []byte
 	err  error
@@ -26,7 +31,12 @@ type processor struct {
 	cfg config
 
 	srv *fh.Server
-	cli *fh.Client
+
+	realIP  *realIPResolver
+	wal     *wal
+	metrics *metrics
+	targets *targetRouter
+	tenant  *tenantResolver
 
 	shuttingDown uint32
 
@@ -39,6 +49,32 @@ func newProcessor(c config) (p *processor, err error) {
 		Logger: logger.NewSimpleLogger("proc"),
 	}
 
+	if p.realIP, err = newRealIPResolver(c.RealIP); err != nil {
+		return nil, err
+	}
+
+	if p.tenant, err = newTenantResolver(c.Tenant); err != nil {
+		return nil, err
+	}
+
+	p.metrics = newMetrics(c.Metrics)
+
+	p.targets, err = newTargetRouter(c, func(url string, from, to breakerState) {
+		p.Warnf("circuit breaker for %s: %s -> %s", url, from, to)
+		p.metrics.observeBreakerTransition(url, to)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p.wal, err = newWAL(c.WAL, func(tenant string, reqID uuid.UUID, ip net.Addr, targetURL string, payload []byte) (int, error) {
+		code, _, sendErr := p.sendPayload(ip, reqID, tenant, payload, p.targets.ruleByURL(targetURL))
+		return code, sendErr
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	p.srv = &fh.Server{
 		Name:    "cortex-tenant",
 		Handler: p.handle,
@@ -50,14 +86,6 @@ func newProcessor(c config) (p *processor, err error) {
 		IdleTimeout:  60 * time.Second,
 	}
 
-	p.cli = &fh.Client{
-		Name:               "cortex-tenant",
-		ReadTimeout:        c.Timeout,
-		WriteTimeout:       c.Timeout,
-		MaxConnWaitTimeout: 1 * time.Second,
-		MaxConnsPerHost:    64,
-	}
-
 	l, err := net.Listen("tcp", c.Listen)
 	if err != nil {
 		return nil, err
@@ -65,8 +93,18 @@ func newProcessor(c config) (p *processor, err error) {
 
 	go p.srv.Serve(l)
 
+	if c.Metrics.Enable && c.Metrics.Listen != "" {
+		lm, err := net.Listen("tcp", c.Metrics.Listen)
+		if err != nil {
+			return nil, err
+		}
+
+		go (&fh.Server{Name: "cortex-tenant-metrics", Handler: p.metrics.handler}).Serve(lm)
+		p.Warnf("Serving metrics on %s", c.Metrics.Listen)
+	}
+
 	p.Warnf("Listening on %s", c.Listen)
-	p.Warnf("Sending to %s", c.Target)
+	p.Warnf("Sending to %s (default) + %d additional target(s)", c.Target, len(c.Targets))
 	return
 }
 
@@ -79,6 +117,11 @@ func (p *processor) handle(ctx *fh.RequestCtx) {
 		return
 	}
 
+	if p.cfg.Metrics.Enable && p.cfg.Metrics.Listen == "" && bytes.Equal(ctx.Path(), []byte("/metrics")) {
+		p.metrics.handler(ctx)
+		return
+	}
+
 	var wrReqIn prompb.WriteRequest
 
 	if !bytes.Equal(ctx.Request.Header.Method(), []byte("POST")) {
@@ -91,6 +134,7 @@ func (p *processor) handle(ctx *fh.RequestCtx) {
 		return
 	}
 
+	p.metrics.bufferGet()
 	buf := bufferPool.Get().(*buffer)
 	buf.grow()
 	defer bufferPool.Put(buf)
@@ -110,7 +154,9 @@ func (p *processor) handle(ctx *fh.RequestCtx) {
 		return
 	}
 
-	ip := ctx.RemoteAddr()
+	ip := p.realIP.resolve(ctx.RemoteAddr(), func(name string) string {
+		return string(ctx.Request.Header.Peek(name))
+	})
 	reqID, _ := uuid.NewRandom()
 
 	// Create per-tenant write requests
@@ -128,22 +174,59 @@ func (p *processor) handle(ctx *fh.RequestCtx) {
 		}
 
 		wrReqOut.Timeseries = append(wrReqOut.Timeseries, ts)
+		p.metrics.observeIngest(tenant, len(ts.Samples), 1)
 		//p.Debugf("src=%s req_id=%s tenant=%s labels=%+v", ip, reqID, tenant, ts.Labels)
 	}
 
+	if p.cfg.WAL.Enable && p.cfg.WAL.Mode == walModeBufferFirst {
+		for tenant, wrReq := range m {
+			for _, t := range p.targets.resolve(tenant) {
+				payload, encErr := p.encode(wrReq)
+				if encErr == nil {
+					encErr = p.wal.append(tenant, reqID, ip, t.cfg.URL, payload)
+				}
+
+				if encErr != nil {
+					ctx.Error(encErr.Error(), fh.StatusServiceUnavailable)
+					p.Errorf("src=%s req_id=%s tenant=%s unable to buffer: %s", ip, reqID, tenant, encErr)
+					return
+				}
+			}
+		}
+
+		return
+	}
+
 	ok := 0
 	var res result
 
 	for _, r := range p.dispatch(ip, reqID, m) {
-		if r.err != nil {
-			err = r.err
-			p.Errorf("src=%s %s", ip, err)
-		} else if r.code < 200 || r.code > 299 {
-			if res.code == 0 {
-				res = r
+		if r.err != nil || r.code < 200 || r.code > 299 {
+			if p.cfg.WAL.Enable {
+				payload, encErr := p.encode(r.wrReq)
+				if encErr == nil {
+					encErr = p.wal.append(r.tenant, reqID, ip, r.targetURL, payload)
+				}
+
+				if encErr == nil {
+					p.Warnf("src=%s req_id=%s tenant=%s upstream send failed, buffered for retry", ip, reqID, r.tenant)
+					ok++
+					continue
+				}
+
+				p.Errorf("src=%s req_id=%s tenant=%s unable to buffer after failed send: %s", ip, reqID, r.tenant, encErr)
 			}
 
-			p.Errorf("src=%s req_id=%s http code not 2xx (%d): %s", ip, reqID, r.code, string(r.body))
+			if r.err != nil {
+				err = r.err
+				p.Errorf("src=%s %s", ip, err)
+			} else {
+				if res.code == 0 {
+					res = r
+				}
+
+				p.Errorf("src=%s req_id=%s http code not 2xx (%d): %s", ip, reqID, r.code, string(r.body))
+			}
 		} else {
 			ok++
 		}
@@ -160,23 +243,34 @@ func (p *processor) handle(ctx *fh.RequestCtx) {
 	return
 }
 
+// dispatch fans each tenant's write request out to every target rule
+// that matches it, building one outbound request per (target, tenant)
+// pair and aggregating the results the same way single-target fan-in
+// used to.
 func (p *processor) dispatch(ip net.Addr, reqID uuid.UUID, m map[string]*prompb.WriteRequest) (res []result) {
-	var wg sync.WaitGroup
-	res = make([]result, len(m))
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
 
-	i := 0
 	for tenant, wrReq := range m {
-		wg.Add(1)
+		for _, t := range p.targets.resolve(tenant) {
+			wg.Add(1)
+
+			go func(tenant string, wrReq *prompb.WriteRequest, t *targetRule) {
+				defer wg.Done()
 
-		go func(idx int, tenant string, wrReq *prompb.WriteRequest) {
-			defer wg.Done()
+				p.metrics.dispatchStart()
+				defer p.metrics.dispatchEnd()
 
-			var r result
-			r.code, r.body, r.err = p.send(ip, reqID, tenant, wrReq)
-			res[idx] = r
-		}(i, tenant, wrReq)
+				r := result{tenant: tenant, targetURL: t.cfg.URL, wrReq: wrReq}
+				r.code, r.body, r.err = p.send(ip, reqID, tenant, wrReq, t)
 
-		i++
+				mu.Lock()
+				res = append(res, r)
+				mu.Unlock()
+			}(tenant, wrReq, t)
+		}
 	}
 
 	wg.Wait()
@@ -184,54 +278,154 @@ func (p *processor) dispatch(ip net.Addr, reqID uuid.UUID, m map[string]*prompb.
 }
 
 func (p *processor) processTimeseries(ts *prompb.TimeSeries) (tenant string) {
-	labelIdx := 0
-	for i, l := range ts.Labels {
-		if l.Name == p.cfg.Tenant.Label {
-			tenant, labelIdx = l.Value, i
-			break
-		}
-	}
-
-	if tenant == "" {
-		return p.cfg.Tenant.Default
-	}
-
-	if p.cfg.Tenant.LabelRemove {
-		l := len(ts.Labels)
-		ts.Labels[labelIdx] = ts.Labels[l-1]
-		ts.Labels = ts.Labels[:l-1]
-	}
-
-	return
+	return p.tenant.resolve(ts)
 }
 
-func (p *processor) send(ip net.Addr, reqID uuid.UUID, tenant string, wr *prompb.WriteRequest) (code int, body []byte, err error) {
-	req := fh.AcquireRequest()
-	resp := fh.AcquireResponse()
-
+// encode marshals a per-tenant write request to Protobuf and compresses
+// it with Snappy, ready to be sent or buffered to the WAL.
+func (p *processor) encode(wr *prompb.WriteRequest) (payload []byte, err error) {
+	p.metrics.bufferGet()
+	p.metrics.bufferGet()
 	buf1 := bufferPool.Get().(*buffer)
 	buf2 := bufferPool.Get().(*buffer)
 	buf1.grow()
 	buf2.grow()
 
 	defer func() {
-		fh.ReleaseRequest(req)
-		fh.ReleaseResponse(resp)
 		bufferPool.Put(buf1)
 		bufferPool.Put(buf2)
 	}()
 
-	// Marshal to Protobuf
 	var l int
 	if l, err = wr.MarshalTo(buf1.b); err != nil {
-		return
+		return nil, err
 	}
 
-	// Compress with Snappy
-	if buf2.b = snappy.Encode(buf2.b, buf1.b[:l]); err != nil {
-		return
+	compressed := snappy.Encode(buf2.b, buf1.b[:l])
+	payload = make([]byte, len(compressed))
+	copy(payload, compressed)
+	return payload, nil
+}
+
+func (p *processor) send(ip net.Addr, reqID uuid.UUID, tenant string, wr *prompb.WriteRequest, t *targetRule) (code int, body []byte, err error) {
+	payload, err := p.encode(wr)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return p.sendPayload(ip, reqID, tenant, payload, t)
+}
+
+// sendPayload delivers an already Protobuf-marshaled, Snappy-compressed
+// write request to the given target, applying cfg.Retry's retry,
+// hedging, and circuit-breaker policy. It's the common path used both
+// by the synchronous dispatch and by the WAL worker replaying buffered
+// entries (which layers its own, coarser per-entry retry on top).
+func (p *processor) sendPayload(ip net.Addr, reqID uuid.UUID, tenant string, payload []byte, t *targetRule) (code int, body []byte, err error) {
+	rc := p.cfg.Retry
+
+	for attempt := 1; attempt <= rc.maxAttempts(); attempt++ {
+		if !t.breaker.allow() {
+			return 0, nil, fmt.Errorf("circuit breaker open for target %s", t.cfg.URL)
+		}
+
+		code, body, err = p.attemptSend(ip, reqID, tenant, payload, t, rc)
+
+		success := err == nil && code >= 200 && code <= 299
+		t.breaker.record(success)
+
+		if success || attempt == rc.maxAttempts() || (err == nil && !rc.isRetryableStatus(code)) {
+			return code, body, err
+		}
+
+		p.metrics.observeRetry(tenant)
+		p.Warnf("src=%s req_id=%s tenant=%s target=%s attempt=%d/%d failed: code=%d err=%v",
+			ip, reqID, tenant, t.cfg.URL, attempt, rc.maxAttempts(), code, err)
+
+		time.Sleep(rc.backoff(attempt))
+	}
+
+	return
+}
+
+// attemptSend makes a single request attempt, optionally hedged: if the
+// first try hasn't returned within cfg.Retry.HedgeDelay, a second,
+// independent attempt is fired and whichever completes first wins. Only
+// the winning attempt is recorded in metrics; a hedge loser that
+// completes afterward is logged and discarded rather than counted
+// again.
+func (p *processor) attemptSend(ip net.Addr, reqID uuid.UUID, tenant string, payload []byte, t *targetRule, rc retryConfig) (code int, body []byte, err error) {
+	type attemptResult struct {
+		code int
+		body []byte
+		dur  time.Duration
+		err  error
+	}
+
+	run := func(out chan<- attemptResult) {
+		c, b, d, e := p.doRequest(ip, reqID, tenant, payload, t)
+		out <- attemptResult{c, b, d, e}
+	}
+
+	observe := func(r attemptResult) {
+		if r.err != nil {
+			p.metrics.observeRequest(tenant, "error", r.dur, len(payload))
+			return
+		}
+
+		p.metrics.observeRequest(tenant, strconv.Itoa(r.code), r.dur, len(payload))
 	}
 
+	discard := func(loser string, ch <-chan attemptResult) {
+		r := <-ch
+		p.Debugf("src=%s req_id=%s tenant=%s target=%s hedge %s attempt completed after the other already won (code=%d err=%v), discarding",
+			ip, reqID, tenant, t.cfg.URL, loser, r.code, r.err)
+	}
+
+	primary := make(chan attemptResult, 1)
+	go run(primary)
+
+	if rc.HedgeDelay <= 0 {
+		r := <-primary
+		observe(r)
+		return r.code, r.body, r.err
+	}
+
+	select {
+	case r := <-primary:
+		observe(r)
+		return r.code, r.body, r.err
+	case <-time.After(rc.HedgeDelay):
+	}
+
+	hedge := make(chan attemptResult, 1)
+	go run(hedge)
+
+	select {
+	case r := <-primary:
+		observe(r)
+		go discard("hedge", hedge)
+		return r.code, r.body, r.err
+	case r := <-hedge:
+		observe(r)
+		go discard("primary", primary)
+		return r.code, r.body, r.err
+	}
+}
+
+// doRequest performs a single, unretried POST of payload to t. Timing
+// and outcome are reported by the caller, not here, so that a hedged
+// attempt that loses the race isn't counted in metrics alongside the
+// winner.
+func (p *processor) doRequest(ip net.Addr, reqID uuid.UUID, tenant string, payload []byte, t *targetRule) (code int, body []byte, dur time.Duration, err error) {
+	req := fh.AcquireRequest()
+	resp := fh.AcquireResponse()
+
+	defer func() {
+		fh.ReleaseRequest(req)
+		fh.ReleaseResponse(resp)
+	}()
+
 	req.Header.SetMethod("POST")
 	req.Header.Set("Content-Encoding", "snappy")
 	req.Header.Set("Content-Type", "application/x-protobuf")
@@ -240,19 +434,33 @@ func (p *processor) send(ip net.Addr, reqID uuid.UUID, tenant string, wr *prompb
 	req.Header.Set("X-Cortex-Tenant-ReqID", reqID.String())
 	req.Header.Set(p.cfg.Tenant.Header, tenant)
 
-	req.SetRequestURI(p.cfg.Target)
-	req.SetBody(buf2.b)
+	for k, v := range t.cfg.Headers {
+		req.Header.Set(k, v)
+	}
 
-	if err = p.cli.Do(req, resp); err != nil {
-		return
+	req.SetRequestURI(t.cfg.URL)
+	req.SetBody(payload)
+
+	start := time.Now()
+	err = t.cli.Do(req, resp)
+	dur = time.Since(start)
+
+	if err != nil {
+		return 0, nil, dur, err
 	}
 
+	code = resp.Header.StatusCode()
+
 	body = make([]byte, len(resp.Body()))
 	copy(body, resp.Body())
-	return resp.Header.StatusCode(), body, nil
+	return code, body, dur, nil
 }
 
 func (p *processor) close() (err error) {
+	if err := p.wal.close(); err != nil {
+		p.Errorf("error closing WAL: %s", err)
+	}
+
 	// Signal that we're shutting down
 	atomic.StoreUint32(&p.shuttingDown, 1)
 	// Let healthcheck detect that we're offline
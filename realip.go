@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// realIPConfig controls how the true client IP is derived when
+// cortex-tenant sits behind a trusted reverse proxy, load balancer, or
+// service mesh. It is disabled by default, in which case the immediate
+// peer address (RemoteAddr) is used as before.
+type realIPConfig struct {
+	Enable bool `yaml:"enable"`
+
+	// TrustedCIDRs lists the proxy networks allowed to supply the
+	// headers below. Only consulted when the immediate peer falls
+	// inside one of them.
+	TrustedCIDRs []string `yaml:"trusted_cidrs"`
+
+	// Headers is the ordered list of header names to consult, e.g.
+	// ["X-Real-Ip", "X-Forwarded-For"]. The first header with a usable
+	// value wins.
+	Headers []string `yaml:"headers"`
+}
+
+// realIPResolver resolves the client address to record for a request,
+// walking trusted-proxy headers when the immediate peer is itself trusted.
+type realIPResolver struct {
+	enabled bool
+	trusted []*net.IPNet
+	headers []string
+}
+
+func newRealIPResolver(cfg realIPConfig) (r *realIPResolver, err error) {
+	r = &realIPResolver{
+		enabled: cfg.Enable,
+		headers: cfg.Headers,
+	}
+
+	for _, c := range cfg.TrustedCIDRs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("real_ip: invalid trusted CIDR %q: %s", c, err)
+		}
+
+		r.trusted = append(r.trusted, n)
+	}
+
+	return r, nil
+}
+
+func (r *realIPResolver) isTrusted(ip net.IP) bool {
+	for _, n := range r.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolve returns the address to record as the request's source: the
+// configured header chain when real_ip is enabled and the peer is
+// trusted, otherwise the raw peer address.
+func (r *realIPResolver) resolve(peerAddr net.Addr, header func(name string) string) net.Addr {
+	if !r.enabled {
+		return peerAddr
+	}
+
+	host, _, err := net.SplitHostPort(peerAddr.String())
+	if err != nil {
+		host = peerAddr.String()
+	}
+
+	peer := net.ParseIP(host)
+	if peer == nil || !r.isTrusted(peer) {
+		return peerAddr
+	}
+
+	for _, h := range r.headers {
+		v := header(h)
+		if v == "" {
+			continue
+		}
+
+		if ip := r.pickFromChain(v); ip != nil {
+			return &net.IPAddr{IP: ip}
+		}
+	}
+
+	return peerAddr
+}
+
+// pickFromChain walks a comma-separated header value (as produced by
+// X-Forwarded-For) right-to-left, skipping hops that are themselves
+// trusted proxies, and returns the first untrusted address found.
+func (r *realIPResolver) pickFromChain(v string) net.IP {
+	parts := strings.Split(v, ",")
+
+	for i := len(parts) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(parts[i]))
+		if ip == nil {
+			continue
+		}
+
+		if !r.isTrusted(ip) {
+			return ip
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// retryConfig controls per-request retry, hedging, and circuit-breaker
+// behavior in processor.sendPayload. Left at its zero value, sendPayload
+// makes exactly one attempt, matching the original behavior.
+type retryConfig struct {
+	MaxAttempts    int           `yaml:"max_attempts"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	Multiplier     float64       `yaml:"multiplier"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+
+	// Jitter is the fraction (0..1) of the computed backoff randomized
+	// away, to avoid thundering-herd retries.
+	Jitter float64 `yaml:"jitter"`
+
+	// RetryableStatus lists upstream status codes worth retrying, in
+	// addition to network errors. Empty means "any non-2xx".
+	RetryableStatus []int `yaml:"retryable_status"`
+
+	// HedgeDelay, if set, fires a second, independent attempt if the
+	// first hasn't returned within this long; whichever completes first
+	// wins.
+	HedgeDelay time.Duration `yaml:"hedge_delay"`
+
+	Breaker breakerConfig `yaml:"breaker"`
+}
+
+func (c retryConfig) maxAttempts() int {
+	if c.MaxAttempts < 1 {
+		return 1
+	}
+
+	return c.MaxAttempts
+}
+
+func (c retryConfig) isRetryableStatus(code int) bool {
+	if len(c.RetryableStatus) == 0 {
+		return code < 200 || code > 299
+	}
+
+	for _, s := range c.RetryableStatus {
+		if s == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backoff computes the delay before the given retry attempt (1-indexed:
+// the delay before attempt 2, 3, ...), with multiplicative growth and
+// jitter.
+func (c retryConfig) backoff(attempt int) time.Duration {
+	initial := c.InitialBackoff
+	if initial <= 0 {
+		initial = 200 * time.Millisecond
+	}
+
+	maxBackoff := c.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 10 * time.Second
+	}
+
+	mult := c.Multiplier
+	if mult <= 1 {
+		mult = 2
+	}
+
+	d := float64(initial)
+	for i := 1; i < attempt; i++ {
+		d *= mult
+	}
+
+	backoff := time.Duration(d)
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+
+	if c.Jitter > 0 {
+		j := c.Jitter
+		if j > 1 {
+			j = 1
+		}
+
+		backoff -= time.Duration(float64(backoff) * j * rand.Float64())
+	}
+
+	return backoff
+}
+
+// breakerState is the state of a circuitBreaker.
+type breakerState int32
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breakerConfig controls a per-target circuit breaker. Disabled by
+// default.
+type breakerConfig struct {
+	Enable bool `yaml:"enable"`
+
+	// WindowSize is how many recent outcomes are tracked.
+	WindowSize int `yaml:"window_size"`
+
+	// MinRequests is the minimum outcomes in the window before the
+	// error ratio is evaluated at all.
+	MinRequests int `yaml:"min_requests"`
+
+	// ErrorThreshold is the failure ratio (0..1) that trips the breaker.
+	ErrorThreshold float64 `yaml:"error_threshold"`
+
+	// OpenDuration is how long the breaker stays open before allowing a
+	// single half-open probe request through.
+	OpenDuration time.Duration `yaml:"open_duration"`
+}
+
+// circuitBreaker trips once a sliding-window error ratio reaches the threshold,
+// short-circuits further sends while open, and allows a single probe
+// request through once OpenDuration has elapsed.
+type circuitBreaker struct {
+	cfg          breakerConfig
+	onTransition func(from, to breakerState)
+
+	mu               sync.Mutex
+	state            breakerState
+	window           []bool
+	openedAt         time.Time
+	halfOpenInFlight bool
+}
+
+func newCircuitBreaker(cfg breakerConfig, onTransition func(from, to breakerState)) *circuitBreaker {
+	return &circuitBreaker{cfg: cfg, onTransition: onTransition}
+}
+
+// allow reports whether a request may proceed, transitioning an
+// expired-open breaker to half-open and admitting exactly one probe.
+func (b *circuitBreaker) allow() bool {
+	if !b.cfg.Enable {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cfg.OpenDuration {
+			return false
+		}
+
+		b.transitionLocked(breakerHalfOpen)
+		b.halfOpenInFlight = true
+		return true
+
+	case breakerHalfOpen:
+		if b.halfOpenInFlight {
+			return false
+		}
+
+		b.halfOpenInFlight = true
+		return true
+
+	default:
+		return true
+	}
+}
+
+// record reports the outcome of a request that allow() admitted.
+func (b *circuitBreaker) record(success bool) {
+	if !b.cfg.Enable {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.halfOpenInFlight = false
+
+		if success {
+			b.window = nil
+			b.transitionLocked(breakerClosed)
+		} else {
+			b.openedAt = time.Now()
+			b.transitionLocked(breakerOpen)
+		}
+
+		return
+	}
+
+	windowSize := b.cfg.WindowSize
+	if windowSize < 1 {
+		windowSize = 20
+	}
+
+	b.window = append(b.window, success)
+	if len(b.window) > windowSize {
+		b.window = b.window[len(b.window)-windowSize:]
+	}
+
+	minRequests := b.cfg.MinRequests
+	if minRequests < 1 {
+		minRequests = windowSize
+	}
+
+	if len(b.window) < minRequests {
+		return
+	}
+
+	failures := 0
+	for _, ok := range b.window {
+		if !ok {
+			failures++
+		}
+	}
+
+	threshold := b.cfg.ErrorThreshold
+	if threshold <= 0 {
+		threshold = 0.5
+	}
+
+	if float64(failures)/float64(len(b.window)) >= threshold {
+		b.openedAt = time.Now()
+		b.transitionLocked(breakerOpen)
+	}
+}
+
+func (b *circuitBreaker) transitionLocked(to breakerState) {
+	from := b.state
+	b.state = to
+
+	if from != to && b.onTransition != nil {
+		b.onTransition(from, to)
+	}
+}
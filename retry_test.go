@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestCircuitBreakerStateMachine drives a breaker through
+// closed -> open -> half-open -> closed and asserts both allow() and the
+// transitions fired at each step.
+func TestCircuitBreakerStateMachine(t *testing.T) {
+	var transitions []string
+
+	cfg := breakerConfig{
+		Enable:         true,
+		WindowSize:     4,
+		MinRequests:    4,
+		ErrorThreshold: 0.5,
+		OpenDuration:   20 * time.Millisecond,
+	}
+
+	cb := newCircuitBreaker(cfg, func(from, to breakerState) {
+		transitions = append(transitions, from.String()+"->"+to.String())
+	})
+
+	if !cb.allow() {
+		t.Fatalf("closed breaker should allow requests")
+	}
+
+	// 2 failures out of 4 outcomes meets the 50% error threshold.
+	cb.record(false)
+	cb.record(false)
+	cb.record(true)
+	cb.record(true)
+
+	if cb.state != breakerOpen {
+		t.Fatalf("state = %v, want open after reaching the error threshold", cb.state)
+	}
+
+	if cb.allow() {
+		t.Fatalf("open breaker should not allow requests before OpenDuration elapses")
+	}
+
+	time.Sleep(cfg.OpenDuration * 2)
+
+	if !cb.allow() {
+		t.Fatalf("breaker should admit exactly one half-open probe once OpenDuration elapses")
+	}
+
+	if cb.state != breakerHalfOpen {
+		t.Fatalf("state = %v, want half-open after admitting a probe", cb.state)
+	}
+
+	if cb.allow() {
+		t.Fatalf("half-open breaker should not admit a second concurrent probe")
+	}
+
+	cb.record(true)
+
+	if cb.state != breakerClosed {
+		t.Fatalf("state = %v, want closed after a successful half-open probe", cb.state)
+	}
+
+	if !cb.allow() {
+		t.Fatalf("closed breaker should allow requests again")
+	}
+
+	want := []string{"closed->open", "open->half-open", "half-open->closed"}
+	if len(transitions) != len(want) {
+		t.Fatalf("transitions = %v, want %v", transitions, want)
+	}
+
+	for i := range want {
+		if transitions[i] != want[i] {
+			t.Fatalf("transitions = %v, want %v", transitions, want)
+		}
+	}
+}
+
+// TestCircuitBreakerHalfOpenFailureReopens verifies that a failed
+// half-open probe reopens the breaker instead of closing it.
+func TestCircuitBreakerHalfOpenFailureReopens(t *testing.T) {
+	cfg := breakerConfig{
+		Enable:         true,
+		WindowSize:     2,
+		MinRequests:    2,
+		ErrorThreshold: 0.5,
+		OpenDuration:   10 * time.Millisecond,
+	}
+
+	cb := newCircuitBreaker(cfg, nil)
+
+	cb.record(false)
+	cb.record(false)
+
+	if cb.state != breakerOpen {
+		t.Fatalf("state = %v, want open after exceeding the error threshold", cb.state)
+	}
+
+	time.Sleep(cfg.OpenDuration * 2)
+
+	if !cb.allow() {
+		t.Fatalf("breaker should admit a half-open probe once OpenDuration elapses")
+	}
+
+	if cb.state != breakerHalfOpen {
+		t.Fatalf("state = %v, want half-open after admitting a probe", cb.state)
+	}
+
+	cb.record(false)
+
+	if cb.state != breakerOpen {
+		t.Fatalf("state = %v, want open again after a failed half-open probe", cb.state)
+	}
+}
+
+// TestCircuitBreakerDisabledAlwaysAllows verifies the zero-value/disabled
+// breaker never blocks requests, matching sendPayload's expectation that
+// it's a no-op when Breaker.Enable is false.
+func TestCircuitBreakerDisabledAlwaysAllows(t *testing.T) {
+	cb := newCircuitBreaker(breakerConfig{}, nil)
+
+	for i := 0; i < 10; i++ {
+		cb.record(false)
+
+		if !cb.allow() {
+			t.Fatalf("disabled breaker should always allow requests")
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	fh "github.com/valyala/fasthttp"
+)
+
+// targetConfig describes one upstream backend and the tenants routed to
+// it. A tenant is matched against Tenants, which accepts exact names,
+// shell-style globs ("team-*"), and regexes (prefixed with "re:"). An
+// entry with an empty Tenants list never matches implicitly - the
+// scalar cfg.Target remains the catch-all for anything that matches no
+// rule.
+type targetConfig struct {
+	URL     string            `yaml:"url"`
+	Tenants []string          `yaml:"tenants"`
+	Timeout time.Duration     `yaml:"timeout"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+// targetRule is a targetConfig with its tenant selector compiled and its
+// own HTTP client, so each target gets an independent connection pool
+// and timeout.
+type targetRule struct {
+	cfg     targetConfig
+	cli     *fh.Client
+	breaker *circuitBreaker
+
+	exact   map[string]struct{}
+	globs   []string
+	regexes []*regexp.Regexp
+}
+
+func newTargetRule(cfg targetConfig, defaultTimeout time.Duration, breakerCfg breakerConfig, onBreakerTransition func(url string, from, to breakerState)) (r *targetRule, err error) {
+	r = &targetRule{cfg: cfg, exact: map[string]struct{}{}}
+
+	r.breaker = newCircuitBreaker(breakerCfg, func(from, to breakerState) {
+		if onBreakerTransition != nil {
+			onBreakerTransition(cfg.URL, from, to)
+		}
+	})
+
+	for _, t := range cfg.Tenants {
+		switch {
+		case strings.HasPrefix(t, "re:"):
+			re, reErr := regexp.Compile(strings.TrimPrefix(t, "re:"))
+			if reErr != nil {
+				return nil, fmt.Errorf("targets: invalid regex %q for %q: %s", t, cfg.URL, reErr)
+			}
+
+			r.regexes = append(r.regexes, re)
+
+		case strings.ContainsAny(t, "*?["):
+			r.globs = append(r.globs, t)
+
+		default:
+			r.exact[t] = struct{}{}
+		}
+	}
+
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	r.cli = &fh.Client{
+		Name:               "cortex-tenant",
+		ReadTimeout:        timeout,
+		WriteTimeout:       timeout,
+		MaxConnWaitTimeout: 1 * time.Second,
+		MaxConnsPerHost:    64,
+	}
+
+	return r, nil
+}
+
+// matches reports whether tenant is selected by this rule. A rule with
+// no Tenants entries never matches here; the default rule built from
+// cfg.Target has none and is only ever returned as the fallback from
+// targetRouter.resolve.
+func (r *targetRule) matches(tenant string) bool {
+	if len(r.cfg.Tenants) == 0 {
+		return false
+	}
+
+	if _, ok := r.exact[tenant]; ok {
+		return true
+	}
+
+	for _, g := range r.globs {
+		if ok, _ := path.Match(g, tenant); ok {
+			return true
+		}
+	}
+
+	for _, re := range r.regexes {
+		if re.MatchString(tenant) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// targetRouter fans a tenant out to every matching target rule, falling
+// back to the scalar cfg.Target when nothing in targets: matches.
+type targetRouter struct {
+	rules []*targetRule
+	def   *targetRule
+	byURL map[string]*targetRule
+}
+
+func newTargetRouter(c config, onBreakerTransition func(url string, from, to breakerState)) (tr *targetRouter, err error) {
+	tr = &targetRouter{byURL: map[string]*targetRule{}}
+
+	for _, t := range c.Targets {
+		rule, ruleErr := newTargetRule(t, c.Timeout, c.Retry.Breaker, onBreakerTransition)
+		if ruleErr != nil {
+			return nil, ruleErr
+		}
+
+		tr.rules = append(tr.rules, rule)
+		tr.byURL[rule.cfg.URL] = rule
+	}
+
+	if tr.def, err = newTargetRule(targetConfig{URL: c.Target}, c.Timeout, c.Retry.Breaker, onBreakerTransition); err != nil {
+		return nil, err
+	}
+
+	tr.byURL[tr.def.cfg.URL] = tr.def
+	return tr, nil
+}
+
+func (tr *targetRouter) resolve(tenant string) []*targetRule {
+	var matched []*targetRule
+
+	for _, r := range tr.rules {
+		if r.matches(tenant) {
+			matched = append(matched, r)
+		}
+	}
+
+	if len(matched) == 0 {
+		return []*targetRule{tr.def}
+	}
+
+	return matched
+}
+
+// ruleByURL looks up the target rule a buffered WAL entry was bound to,
+// so replay uses the same URL, headers, and client pool as the original
+// send.
+func (tr *targetRouter) ruleByURL(url string) *targetRule {
+	if r, ok := tr.byURL[url]; ok {
+		return r
+	}
+
+	return tr.def
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// tenantRuleConfig is one step of the ordered tenant-resolution
+// pipeline. Rules are tried in order; the first one that matches and
+// yields a non-empty tenant wins.
+type tenantRuleConfig struct {
+	// SourceLabels is the ordered list of label names this rule reads.
+	// With no Regex and no Value, the first of these present on the
+	// timeseries supplies the tenant directly (an ordered fallback list).
+	SourceLabels []string `yaml:"source_labels"`
+
+	// Separator joins SourceLabels' values before Regex is applied.
+	// Defaults to ";".
+	Separator string `yaml:"separator"`
+
+	// Regex, if set, must match the joined source label values for the
+	// rule to apply. Its capture groups are available to Value as
+	// $1, $2, ...
+	Regex string `yaml:"regex"`
+
+	// Value is the output template. It may reference regex capture
+	// groups ($1, $2, ...) and/or any label on the timeseries via {name}.
+	// Empty means "use the joined source label value as-is".
+	Value string `yaml:"value"`
+
+	// Match restricts the rule to timeseries carrying the given labels.
+	// A value prefixed with "~" is matched as a regex, otherwise exact.
+	Match map[string]string `yaml:"match"`
+
+	// RemoveSourceLabels strips the source labels whose values this rule
+	// used from the timeseries once it has produced a tenant. In the
+	// ordered-fallback case only the label that supplied the tenant is
+	// removed.
+	RemoveSourceLabels bool `yaml:"remove_source_labels"`
+}
+
+// tenantRule is a tenantRuleConfig with its regexes compiled once at
+// config load time.
+type tenantRule struct {
+	cfg   tenantRuleConfig
+	regex *regexp.Regexp
+	match []tenantMatcher
+}
+
+type tenantMatcher struct {
+	label string
+	exact string
+	regex *regexp.Regexp
+}
+
+func compileTenantRule(rc tenantRuleConfig) (tr *tenantRule, err error) {
+	tr = &tenantRule{cfg: rc}
+
+	if rc.Regex != "" {
+		if tr.regex, err = regexp.Compile(rc.Regex); err != nil {
+			return nil, fmt.Errorf("tenant rule: invalid regex %q: %s", rc.Regex, err)
+		}
+	}
+
+	if len(rc.SourceLabels) == 0 {
+		return nil, fmt.Errorf("tenant rule: source_labels must not be empty")
+	}
+
+	for label, v := range rc.Match {
+		mt := tenantMatcher{label: label}
+
+		if strings.HasPrefix(v, "~") {
+			if mt.regex, err = regexp.Compile(strings.TrimPrefix(v, "~")); err != nil {
+				return nil, fmt.Errorf("tenant rule: invalid match regex %q: %s", v, err)
+			}
+		} else {
+			mt.exact = v
+		}
+
+		tr.match = append(tr.match, mt)
+	}
+
+	return tr, nil
+}
+
+func (tr *tenantRule) separator() string {
+	if tr.cfg.Separator != "" {
+		return tr.cfg.Separator
+	}
+
+	return ";"
+}
+
+func (tr *tenantRule) matches(ts *prompb.TimeSeries) bool {
+	for _, mt := range tr.match {
+		v, _, found := findLabel(ts, mt.label)
+		if !found {
+			return false
+		}
+
+		if mt.regex != nil {
+			if !mt.regex.MatchString(v) {
+				return false
+			}
+		} else if v != mt.exact {
+			return false
+		}
+	}
+
+	return true
+}
+
+// apply evaluates the rule against a timeseries, returning the derived
+// tenant and whether the rule produced one.
+func (tr *tenantRule) apply(ts *prompb.TimeSeries) (tenant string, ok bool) {
+	if !tr.matches(ts) {
+		return "", false
+	}
+
+	var parts []string
+	var idx []int
+
+	for _, name := range tr.cfg.SourceLabels {
+		if v, i, found := findLabel(ts, name); found {
+			parts = append(parts, v)
+			idx = append(idx, i)
+		}
+
+		if tr.regex == nil && tr.cfg.Value == "" && len(parts) > 0 {
+			// Ordered fallback list: the first present label wins.
+			break
+		}
+	}
+
+	if len(parts) == 0 {
+		return "", false
+	}
+
+	value := strings.Join(parts, tr.separator())
+
+	switch {
+	case tr.regex != nil:
+		m := tr.regex.FindStringSubmatch(value)
+		if m == nil {
+			return "", false
+		}
+
+		if tr.cfg.Value != "" {
+			tenant = expandLabelTemplate(expandCaptureGroups(tr.cfg.Value, m), ts)
+		} else {
+			tenant = value
+		}
+
+	case tr.cfg.Value != "":
+		tenant = expandLabelTemplate(tr.cfg.Value, ts)
+
+	default:
+		tenant = value
+	}
+
+	if tenant == "" {
+		return "", false
+	}
+
+	if tr.cfg.RemoveSourceLabels {
+		removeLabelsAt(ts, idx)
+	}
+
+	return tenant, true
+}
+
+// expandCaptureGroups replaces $1, $2, ... (one per capture group) in
+// tmpl with regex capture group values from m (m[0] is the full match).
+func expandCaptureGroups(tmpl string, m []string) string {
+	out := tmpl
+
+	for i := len(m) - 1; i >= 1; i-- {
+		out = strings.ReplaceAll(out, fmt.Sprintf("$%d", i), m[i])
+	}
+
+	return out
+}
+
+var labelPlaceholderRe = regexp.MustCompile(`\{([a-zA-Z_][a-zA-Z0-9_]*)\}`)
+
+// expandLabelTemplate replaces {label_name} in tmpl with that label's
+// value on ts, or the empty string if the timeseries doesn't carry it.
+func expandLabelTemplate(tmpl string, ts *prompb.TimeSeries) string {
+	return labelPlaceholderRe.ReplaceAllStringFunc(tmpl, func(ph string) string {
+		name := ph[1 : len(ph)-1]
+		if v, _, found := findLabel(ts, name); found {
+			return v
+		}
+
+		return ""
+	})
+}
+
+func findLabel(ts *prompb.TimeSeries, name string) (value string, idx int, found bool) {
+	for i, l := range ts.Labels {
+		if l.Name == name {
+			return l.Value, i, true
+		}
+	}
+
+	return "", -1, false
+}
+
+// removeLabelsAt deletes the labels at the given indexes via the same
+// swap-with-last trick used elsewhere, in descending index order so
+// earlier removals don't shift later ones.
+func removeLabelsAt(ts *prompb.TimeSeries, idxs []int) {
+	sort.Sort(sort.Reverse(sort.IntSlice(idxs)))
+
+	for _, i := range idxs {
+		l := len(ts.Labels)
+		ts.Labels[i] = ts.Labels[l-1]
+		ts.Labels = ts.Labels[:l-1]
+	}
+}
+
+// tenantResolver runs the ordered rule pipeline, falling back to the
+// single-label shortcut (Tenant.Label / Tenant.LabelRemove) when no
+// rules are configured, for backward compatibility.
+type tenantResolver struct {
+	rules []*tenantRule
+	def   string
+
+	legacyLabel  string
+	legacyRemove bool
+}
+
+func newTenantResolver(c tenantConfig) (r *tenantResolver, err error) {
+	r = &tenantResolver{
+		def:          c.Default,
+		legacyLabel:  c.Label,
+		legacyRemove: c.LabelRemove,
+	}
+
+	for _, rc := range c.Rules {
+		rule, ruleErr := compileTenantRule(rc)
+		if ruleErr != nil {
+			return nil, ruleErr
+		}
+
+		r.rules = append(r.rules, rule)
+	}
+
+	return r, nil
+}
+
+func (r *tenantResolver) resolve(ts *prompb.TimeSeries) (tenant string) {
+	for _, rule := range r.rules {
+		if t, ok := rule.apply(ts); ok {
+			return t
+		}
+	}
+
+	if len(r.rules) == 0 {
+		return r.resolveLegacy(ts)
+	}
+
+	return r.def
+}
+
+// resolveLegacy is the original single-label lookup, kept as-is when no
+// rules: pipeline is configured.
+func (r *tenantResolver) resolveLegacy(ts *prompb.TimeSeries) (tenant string) {
+	labelIdx := 0
+
+	for i, l := range ts.Labels {
+		if l.Name == r.legacyLabel {
+			tenant, labelIdx = l.Value, i
+			break
+		}
+	}
+
+	if tenant == "" {
+		return r.def
+	}
+
+	if r.legacyRemove {
+		l := len(ts.Labels)
+		ts.Labels[labelIdx] = ts.Labels[l-1]
+		ts.Labels = ts.Labels[:l-1]
+	}
+
+	return
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blind-oracle/go-common/logger"
+	"github.com/google/uuid"
+)
+
+// walConfig controls the optional on-disk write-ahead buffer that lets
+// cortex-tenant absorb an upstream outage instead of dropping samples.
+// It is disabled by default.
+type walConfig struct {
+	Enable bool `yaml:"enable"`
+
+	// Mode selects how handle() uses the buffer:
+	//   "pass-through" (default) - send synchronously as before, and
+	//     only fall back to the buffer when the send fails.
+	//   "buffer-first" - always persist before returning 2xx, and let
+	//     the background worker perform the actual send.
+	Mode string `yaml:"mode"`
+
+	Dir string `yaml:"dir"`
+
+	// MaxSizeBytes bounds the total size of the WAL directory.
+	// FullPolicy decides what happens once it's reached.
+	MaxSizeBytes int64  `yaml:"max_size_bytes"`
+	FullPolicy   string `yaml:"full_policy"` // "drop-oldest" (default) or "refuse-new"
+
+	SegmentSizeBytes int64 `yaml:"segment_size_bytes"`
+
+	WorkerConcurrency  int `yaml:"worker_concurrency"`
+	MaxInFlightRetries int `yaml:"max_in_flight_retries"`
+
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+}
+
+const (
+	walModePassThrough = "pass-through"
+	walModeBufferFirst = "buffer-first"
+
+	walFullPolicyDropOldest = "drop-oldest"
+	walFullPolicyRefuseNew  = "refuse-new"
+
+	walSegmentPrefix = "seg-"
+	walSegmentSuffix = ".wal"
+)
+
+// wal is a segmented, on-disk write-ahead buffer: handle() appends
+// per-tenant requests here, and background workers drain segments in
+// FIFO order, retrying each entry's delivery to the target URL it was
+// buffered for with backoff, and delete a segment once every entry in
+// it has either succeeded or exhausted its retries.
+type wal struct {
+	cfg walConfig
+	snd func(tenant string, reqID uuid.UUID, ip net.Addr, targetURL string, payload []byte) (code int, err error)
+
+	mu      sync.Mutex
+	segFile *os.File
+	segSize int64
+	segSeq  uint64
+	dirSize int64
+
+	// inFlight tracks segments a worker is currently draining, so the
+	// dispatcher never hands the same segment to two workers at once.
+	inFlight map[string]struct{}
+	segCh    chan string
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+
+	logger.Logger
+}
+
+func newWAL(cfg walConfig, snd func(string, uuid.UUID, net.Addr, string, []byte) (int, error)) (w *wal, err error) {
+	w = &wal{
+		cfg:      cfg,
+		snd:      snd,
+		inFlight: map[string]struct{}{},
+		segCh:    make(chan string),
+		stopCh:   make(chan struct{}),
+		Logger:   logger.NewSimpleLogger("wal"),
+	}
+
+	if !cfg.Enable {
+		return w, nil
+	}
+
+	if err = os.MkdirAll(cfg.Dir, 0o750); err != nil {
+		return nil, fmt.Errorf("wal: unable to create dir %q: %s", cfg.Dir, err)
+	}
+
+	segs, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range segs {
+		if fi, statErr := os.Stat(s); statErr == nil {
+			w.dirSize += fi.Size()
+		}
+
+		if seq, ok := parseSegmentSeq(s); ok && seq >= w.segSeq {
+			w.segSeq = seq + 1
+		}
+	}
+
+	concurrency := cfg.WorkerConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	w.wg.Add(1)
+	go w.dispatch()
+
+	for i := 0; i < concurrency; i++ {
+		w.wg.Add(1)
+		go w.worker()
+	}
+
+	w.Warnf("Buffering to %s (mode=%s)", cfg.Dir, cfg.Mode)
+	return w, nil
+}
+
+func parseSegmentSeq(path string) (seq uint64, ok bool) {
+	name := filepath.Base(path)
+	name = strings.TrimPrefix(name, walSegmentPrefix)
+	name = strings.TrimSuffix(name, walSegmentSuffix)
+
+	n, err := strconv.ParseUint(name, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return n, true
+}
+
+func (w *wal) segments() (paths []string, err error) {
+	matches, err := filepath.Glob(filepath.Join(w.cfg.Dir, walSegmentPrefix+"*"+walSegmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// append persists a single tenant's write request, compressed and framed
+// with enough metadata (tenant, request ID, source IP, target URL) to
+// retry and audit it later. It rotates to a fresh segment before a
+// write that would take the current one past SegmentSizeBytes, and
+// enforces MaxSizeBytes per FullPolicy.
+func (w *wal) append(tenant string, reqID uuid.UUID, ip net.Addr, targetURL string, payload []byte) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	entry := encodeWALEntry(tenant, reqID, ip.String(), targetURL, payload)
+	need := int64(len(entry))
+
+	if w.cfg.MaxSizeBytes > 0 && w.dirSize+need > w.cfg.MaxSizeBytes {
+		switch w.cfg.FullPolicy {
+		case walFullPolicyRefuseNew:
+			return fmt.Errorf("wal: buffer full (%d/%d bytes), refusing new entry", w.dirSize, w.cfg.MaxSizeBytes)
+		default: // drop-oldest
+			if err = w.dropOldestLocked(need); err != nil {
+				return err
+			}
+		}
+	}
+
+	if w.segFile == nil || (w.cfg.SegmentSizeBytes > 0 && w.segSize+need > w.cfg.SegmentSizeBytes) {
+		if err = w.rotateLocked(); err != nil {
+			return err
+		}
+	}
+
+	n, err := w.segFile.Write(entry)
+	if err != nil {
+		return fmt.Errorf("wal: write failed: %s", err)
+	}
+
+	w.segSize += int64(n)
+	w.dirSize += int64(n)
+	return nil
+}
+
+func (w *wal) rotateLocked() (err error) {
+	if w.segFile != nil {
+		if err = w.segFile.Close(); err != nil {
+			return fmt.Errorf("wal: unable to close segment: %s", err)
+		}
+	}
+
+	path := filepath.Join(w.cfg.Dir, fmt.Sprintf("%s%020d%s", walSegmentPrefix, w.segSeq, walSegmentSuffix))
+	w.segSeq++
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("wal: unable to create segment %q: %s", path, err)
+	}
+
+	w.segFile = f
+	w.segSize = 0
+	return nil
+}
+
+// dropOldestLocked deletes complete segments, oldest first, until there's
+// room for an incoming entry of size `need`. The currently-open segment
+// is never dropped.
+func (w *wal) dropOldestLocked(need int64) (err error) {
+	segs, err := w.segments()
+	if err != nil {
+		return err
+	}
+
+	var active string
+	if w.segFile != nil {
+		active = w.segFile.Name()
+	}
+
+	for _, s := range segs {
+		if w.dirSize+need <= w.cfg.MaxSizeBytes {
+			break
+		}
+
+		if s == active {
+			continue
+		}
+
+		fi, statErr := os.Stat(s)
+		if statErr != nil {
+			continue
+		}
+
+		if rmErr := os.Remove(s); rmErr != nil {
+			w.Warnf("unable to drop oldest segment %s: %s", s, rmErr)
+			continue
+		}
+
+		w.dirSize -= fi.Size()
+		w.Warnf("dropped oldest segment %s to make room (%d bytes)", s, fi.Size())
+	}
+
+	return nil
+}
+
+func (w *wal) close() (err error) {
+	if !w.cfg.Enable {
+		return nil
+	}
+
+	close(w.stopCh)
+	w.wg.Wait()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.segFile != nil {
+		err = w.segFile.Close()
+	}
+
+	return err
+}
+
+// dispatch lists segments in FIFO order and hands each non-active one to
+// a worker over segCh, tracking in-flight segments so the same segment
+// is never queued to two workers at once. It's the only goroutine that
+// hands segments to workers, which is what makes that claim hold with
+// WorkerConcurrency > 1.
+func (w *wal) dispatch() {
+	defer w.wg.Done()
+	defer close(w.segCh)
+
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		default:
+		}
+
+		segs, err := w.segments()
+		if err != nil {
+			w.Errorf("unable to list segments: %s", err)
+		}
+
+		queued := false
+
+		for _, s := range segs {
+			w.mu.Lock()
+			// Never drain the segment that's still being appended to;
+			// it'll be picked up once rotated.
+			active := w.segFile != nil && s == w.segFile.Name()
+			_, claimed := w.inFlight[s]
+
+			if active || claimed {
+				w.mu.Unlock()
+				continue
+			}
+
+			w.inFlight[s] = struct{}{}
+			w.mu.Unlock()
+
+			select {
+			case w.segCh <- s:
+				queued = true
+			case <-w.stopCh:
+				w.mu.Lock()
+				delete(w.inFlight, s)
+				w.mu.Unlock()
+				return
+			}
+		}
+
+		if !queued {
+			select {
+			case <-w.stopCh:
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+// worker drains segments handed to it over segCh, retrying each entry
+// against the configured sender with exponential backoff and jitter, and
+// releasing the segment's claim once drainSegment returns.
+func (w *wal) worker() {
+	defer w.wg.Done()
+
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		case s, ok := <-w.segCh:
+			if !ok {
+				return
+			}
+
+			w.drainSegment(s)
+
+			w.mu.Lock()
+			delete(w.inFlight, s)
+			w.mu.Unlock()
+		}
+	}
+}
+
+// drainSegment replays every entry in a segment and removes it once all
+// entries have either succeeded or exhausted their retry budget.
+func (w *wal) drainSegment(path string) (ok bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		w.Errorf("unable to open segment %s: %s", path, err)
+		return false
+	}
+	defer f.Close()
+
+	for {
+		entry, err := decodeWALEntry(f)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			w.Errorf("segment %s corrupt, abandoning remainder: %s", path, err)
+			break
+		}
+
+		w.sendWithRetry(entry)
+	}
+
+	// A shutdown cuts sendWithRetry short; keep the segment so it's
+	// replayed on restart.
+	select {
+	case <-w.stopCh:
+		return false
+	default:
+	}
+
+	size := int64(0)
+	if fi, statErr := f.Stat(); statErr == nil {
+		size = fi.Size()
+	}
+
+	if err = os.Remove(path); err != nil {
+		w.Errorf("unable to remove drained segment %s: %s", path, err)
+		return false
+	}
+
+	w.mu.Lock()
+	w.dirSize -= size
+	if w.dirSize < 0 {
+		w.dirSize = 0
+	}
+	w.mu.Unlock()
+
+	return true
+}
+
+func (w *wal) sendWithRetry(e walEntry) {
+	backoff := w.cfg.InitialBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+
+	maxBackoff := w.cfg.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 30 * time.Second
+	}
+
+	maxAttempts := w.cfg.MaxInFlightRetries
+	if maxAttempts < 1 {
+		maxAttempts = 10
+	}
+
+	addr := stringAddr(e.srcIP)
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		code, err := w.snd(e.tenant, e.reqID, addr, e.targetURL, e.payload)
+		if err == nil && code >= 200 && code <= 299 {
+			return
+		}
+
+		w.Warnf("retry %d/%d tenant=%s req_id=%s failed: code=%d err=%v", attempt, maxAttempts, e.tenant, e.reqID, code, err)
+
+		if attempt == maxAttempts {
+			w.Errorf("giving up on tenant=%s req_id=%s after %d attempts", e.tenant, e.reqID, maxAttempts)
+			return
+		}
+
+		sleep := backoff + time.Duration(rand.Int63n(int64(backoff)+1))
+		if sleep > maxBackoff {
+			sleep = maxBackoff
+		}
+
+		select {
+		case <-w.stopCh:
+			return
+		case <-time.After(sleep):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// walEntry is a single buffered per-tenant write request.
+type walEntry struct {
+	tenant    string
+	reqID     uuid.UUID
+	srcIP     string
+	targetURL string
+	payload   []byte // snappy-compressed protobuf WriteRequest
+}
+
+// encodeWALEntry frames an entry as:
+//
+//	u32 tenant_len | tenant | 16 reqID | u16 ip_len | ip | u16 url_len | url | u32 payload_len | payload
+func encodeWALEntry(tenant string, reqID uuid.UUID, ip, targetURL string, payload []byte) []byte {
+	size := 4 + len(tenant) + 16 + 2 + len(ip) + 2 + len(targetURL) + 4 + len(payload)
+	buf := make([]byte, size)
+	off := 0
+
+	binary.BigEndian.PutUint32(buf[off:], uint32(len(tenant)))
+	off += 4
+	off += copy(buf[off:], tenant)
+
+	off += copy(buf[off:], reqID[:])
+
+	binary.BigEndian.PutUint16(buf[off:], uint16(len(ip)))
+	off += 2
+	off += copy(buf[off:], ip)
+
+	binary.BigEndian.PutUint16(buf[off:], uint16(len(targetURL)))
+	off += 2
+	off += copy(buf[off:], targetURL)
+
+	binary.BigEndian.PutUint32(buf[off:], uint32(len(payload)))
+	off += 4
+	copy(buf[off:], payload)
+
+	return buf
+}
+
+func decodeWALEntry(r io.Reader) (e walEntry, err error) {
+	var u32 [4]byte
+	var u16 [2]byte
+	var reqID [16]byte
+
+	if _, err = io.ReadFull(r, u32[:]); err != nil {
+		return e, err
+	}
+
+	tenant := make([]byte, binary.BigEndian.Uint32(u32[:]))
+	if _, err = io.ReadFull(r, tenant); err != nil {
+		return e, err
+	}
+
+	if _, err = io.ReadFull(r, reqID[:]); err != nil {
+		return e, err
+	}
+
+	if _, err = io.ReadFull(r, u16[:]); err != nil {
+		return e, err
+	}
+
+	ip := make([]byte, binary.BigEndian.Uint16(u16[:]))
+	if _, err = io.ReadFull(r, ip); err != nil {
+		return e, err
+	}
+
+	if _, err = io.ReadFull(r, u16[:]); err != nil {
+		return e, err
+	}
+
+	targetURL := make([]byte, binary.BigEndian.Uint16(u16[:]))
+	if _, err = io.ReadFull(r, targetURL); err != nil {
+		return e, err
+	}
+
+	if _, err = io.ReadFull(r, u32[:]); err != nil {
+		return e, err
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint32(u32[:]))
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return e, err
+	}
+
+	return walEntry{
+		tenant:    string(tenant),
+		reqID:     uuid.UUID(reqID),
+		srcIP:     string(ip),
+		targetURL: string(targetURL),
+		payload:   payload,
+	}, nil
+}
+
+// stringAddr is a minimal net.Addr wrapping a pre-resolved address
+// string, used to replay a buffered entry's original source IP.
+type stringAddr string
+
+func (a stringAddr) Network() string { return "ip" }
+func (a stringAddr) String() string  { return string(a) }
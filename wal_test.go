@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/blind-oracle/go-common/logger"
+	"github.com/google/uuid"
+)
+
+func newTestWAL(cfg walConfig) *wal {
+	return &wal{
+		cfg: cfg,
+		snd: func(tenant string, reqID uuid.UUID, ip net.Addr, targetURL string, payload []byte) (int, error) {
+			return 200, nil
+		},
+		inFlight: map[string]struct{}{},
+		stopCh:   make(chan struct{}),
+		Logger:   logger.NewSimpleLogger("wal-test"),
+	}
+}
+
+// TestWALDirSizeAccounting verifies that dirSize tracks the on-disk
+// segment size exactly after appending, and drops back to zero once
+// drainSegment removes the segment - the bug fixed here was dirSize
+// never being decremented on a successful drain.
+func TestWALDirSizeAccounting(t *testing.T) {
+	w := newTestWAL(walConfig{Dir: t.TempDir(), SegmentSizeBytes: 4096})
+
+	addr := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	for i := 0; i < 5; i++ {
+		if err := w.append("tenant-a", uuid.New(), addr, "http://upstream/api/v1/push", []byte("sample-payload")); err != nil {
+			t.Fatalf("append %d: %s", i, err)
+		}
+	}
+
+	segs, err := w.segments()
+	if err != nil || len(segs) != 1 {
+		t.Fatalf("expected exactly one segment, got %v (err=%v)", segs, err)
+	}
+
+	fi, err := os.Stat(segs[0])
+	if err != nil {
+		t.Fatalf("stat segment: %s", err)
+	}
+
+	if w.dirSize != fi.Size() {
+		t.Fatalf("dirSize = %d, want %d (on-disk segment size)", w.dirSize, fi.Size())
+	}
+
+	if !w.drainSegment(segs[0]) {
+		t.Fatalf("drainSegment reported failure")
+	}
+
+	if w.dirSize != 0 {
+		t.Fatalf("dirSize = %d, want 0 after drainSegment removed the only segment", w.dirSize)
+	}
+}
+
+// TestWALDropOldestAccounting verifies that dirSize stays in lockstep
+// with the sum of on-disk segment sizes while FullPolicy: drop-oldest is
+// repeatedly evicting segments to stay under MaxSizeBytes.
+func TestWALDropOldestAccounting(t *testing.T) {
+	w := newTestWAL(walConfig{
+		Dir:              t.TempDir(),
+		SegmentSizeBytes: 64,
+		MaxSizeBytes:     256,
+		FullPolicy:       walFullPolicyDropOldest,
+	})
+
+	addr := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	payload := []byte("0123456789")
+
+	for i := 0; i < 20; i++ {
+		if err := w.append("tenant-a", uuid.New(), addr, "http://upstream/api/v1/push", payload); err != nil {
+			t.Fatalf("append %d: %s", i, err)
+		}
+	}
+
+	if w.dirSize > w.cfg.MaxSizeBytes {
+		t.Fatalf("dirSize = %d exceeds MaxSizeBytes = %d, drop-oldest should keep it bounded", w.dirSize, w.cfg.MaxSizeBytes)
+	}
+
+	segs, err := w.segments()
+	if err != nil {
+		t.Fatalf("segments: %s", err)
+	}
+
+	var total int64
+	for _, s := range segs {
+		fi, statErr := os.Stat(s)
+		if statErr != nil {
+			t.Fatalf("stat %s: %s", s, statErr)
+		}
+
+		total += fi.Size()
+	}
+
+	if total != w.dirSize {
+		t.Fatalf("sum of on-disk segment sizes = %d, dirSize tracked = %d, want equal", total, w.dirSize)
+	}
+}